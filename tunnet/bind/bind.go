@@ -0,0 +1,236 @@
+// Package bind implements a UDP socket abstraction modeled on
+// wireguard-go's Bind/Endpoint pair: a Bind owns the sockets behind a
+// single UDP port, and Endpoint values remember which local address a
+// peer's packets arrived on, so replies can be sent from that same
+// address instead of whatever the kernel picks by default.
+package bind
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Endpoint identifies a UDP peer together with the local source
+// address its packets were most recently received on.
+type Endpoint interface {
+	// DstIP is the peer's address.
+	DstIP() net.IP
+	// SrcIP is the local address the last packet from this peer
+	// arrived on, or nil if none has been recorded yet.
+	SrcIP() net.IP
+	// ClearSrc forgets the cached source address, e.g. after a Send
+	// using it fails.
+	ClearSrc()
+	// DstToString renders the peer's address and port for logging.
+	DstToString() string
+}
+
+// Bind owns the sockets backing a single UDP port, for both IPv4 and
+// IPv6 peers.
+type Bind interface {
+	// Open listens on port (0 picks an ephemeral port) and returns the
+	// port actually bound.
+	Open(port uint16) (actualPort uint16, err error)
+
+	// ReceiveIPv4 reads a single IPv4 packet into buf, returning the
+	// endpoint it came from.
+	ReceiveIPv4(buf []byte) (n int, ep Endpoint, err error)
+
+	// ReceiveIPv6 reads a single IPv6 packet into buf, returning the
+	// endpoint it came from.
+	ReceiveIPv6(buf []byte) (n int, ep Endpoint, err error)
+
+	// Send writes buf to ep, reusing ep's cached source address (if
+	// any) so the reply exits the same interface the request arrived
+	// on. This matters for multihomed hosts, where the kernel's
+	// default route may not be the interface the peer is reachable
+	// through.
+	Send(buf []byte, ep Endpoint) error
+
+	// ParseEndpoint parses a "host:port" address into an Endpoint with
+	// no cached source address.
+	ParseEndpoint(s string) (Endpoint, error)
+
+	// SetMark sets the socket mark used for policy routing (SO_MARK on
+	// Linux). It's a no-op on platforms with no equivalent.
+	SetMark(mark uint32) error
+
+	// Close releases both sockets.
+	Close() error
+}
+
+// stdEndpoint is the Endpoint implementation returned by StdNetBind.
+type stdEndpoint struct {
+	dst net.UDPAddr
+
+	srcLock  sync.Mutex
+	src      net.IP
+	srcIface int
+}
+
+func (e *stdEndpoint) DstIP() net.IP { return e.dst.IP }
+
+func (e *stdEndpoint) SrcIP() net.IP {
+	src, _ := e.srcInfo()
+	return src
+}
+
+func (e *stdEndpoint) srcInfo() (net.IP, int) {
+	e.srcLock.Lock()
+	defer e.srcLock.Unlock()
+	return e.src, e.srcIface
+}
+
+func (e *stdEndpoint) setSrc(src net.IP, iface int) {
+	e.srcLock.Lock()
+	defer e.srcLock.Unlock()
+	e.src = src
+	e.srcIface = iface
+}
+
+func (e *stdEndpoint) ClearSrc() {
+	e.setSrc(nil, 0)
+}
+
+func (e *stdEndpoint) DstToString() string { return e.dst.String() }
+
+// StdNetBind is the default cross-platform Bind, built on the standard
+// library's net package plus golang.org/x/net/ipv4 and ipv6 for access
+// to packet control messages (source/destination address and
+// interface index), which net.UDPConn doesn't expose on its own.
+type StdNetBind struct {
+	udp4 *net.UDPConn
+	udp6 *net.UDPConn
+
+	ipv4Conn *ipv4.PacketConn
+	ipv6Conn *ipv6.PacketConn
+
+	closeOnce sync.Once
+}
+
+// NewStdNetBind creates a Bind that hasn't been opened on a port yet.
+func NewStdNetBind() *StdNetBind {
+	return &StdNetBind{}
+}
+
+func (b *StdNetBind) Open(port uint16) (actualPort uint16, err error) {
+	udp4, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return 0, err
+	}
+	actualPort = uint16(udp4.LocalAddr().(*net.UDPAddr).Port)
+
+	udp6, err := net.ListenUDP("udp6", &net.UDPAddr{Port: int(actualPort)})
+	if err != nil {
+		udp4.Close()
+		return 0, err
+	}
+
+	b.udp4, b.udp6 = udp4, udp6
+	b.ipv4Conn = ipv4.NewPacketConn(udp4)
+	b.ipv6Conn = ipv6.NewPacketConn(udp6)
+
+	if err := b.ipv4Conn.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+		b.Close()
+		return 0, err
+	}
+	if err := b.ipv6Conn.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true); err != nil {
+		b.Close()
+		return 0, err
+	}
+
+	return actualPort, nil
+}
+
+func (b *StdNetBind) ReceiveIPv4(buf []byte) (n int, ep Endpoint, err error) {
+	n, cm, src, err := b.ipv4Conn.ReadFrom(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	e := &stdEndpoint{dst: *src.(*net.UDPAddr)}
+	if cm != nil {
+		e.setSrc(cm.Dst, cm.IfIndex)
+	}
+	return n, e, nil
+}
+
+func (b *StdNetBind) ReceiveIPv6(buf []byte) (n int, ep Endpoint, err error) {
+	n, cm, src, err := b.ipv6Conn.ReadFrom(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	e := &stdEndpoint{dst: *src.(*net.UDPAddr)}
+	if cm != nil {
+		e.setSrc(cm.Dst, cm.IfIndex)
+	}
+	return n, e, nil
+}
+
+func (b *StdNetBind) Send(buf []byte, ep Endpoint) error {
+	e, ok := ep.(*stdEndpoint)
+	if !ok {
+		return errors.New("bind: endpoint wasn't created by this Bind")
+	}
+	src, iface := e.srcInfo()
+
+	if e.dst.IP.To4() != nil {
+		var cm *ipv4.ControlMessage
+		if src != nil {
+			// NOTE: on freebsd, golang.org/x/net/ipv4 has no ctlPacketInfo
+			// entry (only ctlDst/ctlInterface), so ControlMessage.Marshal
+			// silently drops cm.Src here and the reply goes out with
+			// whatever source address the kernel's routing picks instead
+			// of the cached one. Fixing this needs a freebsd-specific
+			// IP_SENDSRCADDR ancillary message, which x/net doesn't build
+			// for us.
+			cm = &ipv4.ControlMessage{Src: src, IfIndex: iface}
+		}
+		_, err := b.ipv4Conn.WriteTo(buf, cm, &e.dst)
+		return err
+	}
+
+	var cm *ipv6.ControlMessage
+	if src != nil {
+		cm = &ipv6.ControlMessage{Src: src, IfIndex: iface}
+	}
+	_, err := b.ipv6Conn.WriteTo(buf, cm, &e.dst)
+	return err
+}
+
+func (b *StdNetBind) ParseEndpoint(s string) (Endpoint, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("bind: invalid IP address " + host)
+	}
+	return &stdEndpoint{dst: net.UDPAddr{IP: ip, Port: port}}, nil
+}
+
+func (b *StdNetBind) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		if b.ipv4Conn != nil {
+			if e := b.ipv4Conn.Close(); e != nil {
+				err = e
+			}
+		}
+		if b.ipv6Conn != nil {
+			if e := b.ipv6Conn.Close(); e != nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,89 @@
+package bind
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestStdNetBindRoundTrip(t *testing.T) {
+	server := NewStdNetBind()
+	serverPort, err := server.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := NewStdNetBind()
+	if _, err := client.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	serverEp, err := client.ParseEndpoint(fmt.Sprintf("127.0.0.1:%d", serverPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte("hello from the client")
+	if err := client.Send(want, serverEp); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(want)+1)
+	n, clientEp, err := server.ReceiveIPv4(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:n]) != string(want) {
+		t.Errorf("expected %q, got %q", want, got[:n])
+	}
+
+	// The endpoint the server just received from should have a cached
+	// source address, since Open enables the control-message flags that
+	// populate it on every ReceiveIPv4.
+	if clientEp.SrcIP() == nil {
+		t.Error("expected SrcIP to be populated after receiving a packet")
+	}
+
+	reply := []byte("hello from the server")
+	if err := server.Send(reply, clientEp); err != nil {
+		t.Fatal(err)
+	}
+
+	gotReply := make([]byte, len(reply)+1)
+	n, _, err = client.ReceiveIPv4(gotReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotReply[:n]) != string(reply) {
+		t.Errorf("expected %q, got %q", reply, gotReply[:n])
+	}
+}
+
+func TestStdNetBindParseEndpointInvalid(t *testing.T) {
+	b := NewStdNetBind()
+	if _, err := b.ParseEndpoint("not-an-address"); err == nil {
+		t.Error("expected an error for a malformed address")
+	}
+	if _, err := b.ParseEndpoint("not-an-ip:1234"); err == nil {
+		t.Error("expected an error for an unparseable IP")
+	}
+}
+
+func TestStdEndpointClearSrc(t *testing.T) {
+	b := NewStdNetBind()
+	ep, err := b.ParseEndpoint("127.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := ep.(*stdEndpoint)
+	e.setSrc(net.ParseIP("127.0.0.1"), 1)
+	if e.SrcIP() == nil {
+		t.Fatal("expected SrcIP to be set")
+	}
+	e.ClearSrc()
+	if e.SrcIP() != nil {
+		t.Error("expected SrcIP to be cleared")
+	}
+}
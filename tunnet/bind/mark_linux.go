@@ -0,0 +1,34 @@
+// +build linux
+
+package bind
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetMark sets SO_MARK on both the IPv4 and IPv6 sockets, for
+// integration with Linux policy routing (e.g. ip rule / ip route
+// lookup tables keyed on fwmark).
+func (b *StdNetBind) SetMark(mark uint32) error {
+	for _, conn := range []*net.UDPConn{b.udp4, b.udp6} {
+		if conn == nil {
+			continue
+		}
+		sc, err := conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var sockErr error
+		if err := sc.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+		}); err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return sockErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package bind
+
+// SetMark is a no-op outside Linux: SO_MARK has no portable equivalent,
+// and platforms that need policy routing use other mechanisms (e.g.
+// routing domains on BSD).
+func (b *StdNetBind) SetMark(mark uint32) error {
+	return nil
+}
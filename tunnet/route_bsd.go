@@ -0,0 +1,141 @@
+// +build darwin freebsd
+
+package tunnet
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+var rtSeqCounter int32
+
+// rtSeq returns a fresh, process-unique rtm_seq value so the kernel's
+// reply to our own request can be told apart from unrelated routing
+// socket traffic.
+func rtSeq() int32 {
+	return atomic.AddInt32(&rtSeqCounter, 1)
+}
+
+// addRoute and deleteRoute manage routes through a PF_ROUTE socket
+// (RTM_ADD/RTM_DELETE), the same mechanism the route(8) command and
+// nebula's darwin/freebsd backends use. listRoutes reads the kernel's
+// routing table back out via the NET_RT_DUMP sysctl.
+
+func addRoute(ifIndex int, dst *net.IPNet, gw net.IP) error {
+	return sendRouteMessage(unix.RTM_ADD, ifIndex, dst, gw)
+}
+
+func deleteRoute(ifIndex int, dst *net.IPNet, gw net.IP) error {
+	return sendRouteMessage(unix.RTM_DELETE, ifIndex, dst, gw)
+}
+
+func sendRouteMessage(typ int, ifIndex int, dst *net.IPNet, gw net.IP) error {
+	sock, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+
+	addrs := make(map[int]route.Addr)
+	addrs[unix.RTAX_DST] = routeAddr(dst.IP)
+	addrs[unix.RTAX_NETMASK] = routeAddr(net.IP(dst.Mask))
+
+	flags := unix.RTF_UP | unix.RTF_STATIC
+	if gw != nil {
+		addrs[unix.RTAX_GATEWAY] = routeAddr(gw)
+		flags |= unix.RTF_GATEWAY
+	}
+
+	msg := &route.RouteMessage{
+		Version: unix.RTM_VERSION,
+		Type:    typ,
+		Flags:   flags,
+		Index:   ifIndex,
+		ID:      uintptr(os.Getpid()),
+		Seq:     int(rtSeq()),
+		Addrs:   addrsToSlice(addrs),
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = unix.Write(sock, data)
+	return err
+}
+
+func listRoutes(ifIndex int) ([]Route, error) {
+	rib, err := route.FetchRIB(unix.AF_UNSPEC, unix.NET_RT_DUMP, 0)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := route.ParseRIB(unix.NET_RT_DUMP, rib)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []Route
+	for _, m := range msgs {
+		rm, ok := m.(*route.RouteMessage)
+		if !ok || rm.Index != ifIndex || rm.Flags&unix.RTF_UP == 0 {
+			continue
+		}
+
+		dst := addrToIP(rm.Addrs, unix.RTAX_DST)
+		if dst == nil {
+			continue
+		}
+		mask := addrToIP(rm.Addrs, unix.RTAX_NETMASK)
+		if mask == nil {
+			mask = net.IP(net.CIDRMask(len(dst)*8, len(dst)*8))
+		}
+
+		routes = append(routes, Route{
+			Dst:     &net.IPNet{IP: dst, Mask: net.IPMask(mask)},
+			Gateway: addrToIP(rm.Addrs, unix.RTAX_GATEWAY),
+		})
+	}
+	return routes, nil
+}
+
+func routeAddr(ip net.IP) route.Addr {
+	if ip4 := ip.To4(); ip4 != nil {
+		var a route.Inet4Addr
+		copy(a.IP[:], ip4)
+		return &a
+	}
+	var a route.Inet6Addr
+	copy(a.IP[:], ip.To16())
+	return &a
+}
+
+func addrToIP(addrs []route.Addr, index int) net.IP {
+	if index >= len(addrs) || addrs[index] == nil {
+		return nil
+	}
+	switch a := addrs[index].(type) {
+	case *route.Inet4Addr:
+		return net.IP(a.IP[:])
+	case *route.Inet6Addr:
+		return net.IP(a.IP[:])
+	default:
+		return nil
+	}
+}
+
+func addrsToSlice(addrs map[int]route.Addr) []route.Addr {
+	max := unix.RTAX_GATEWAY
+	for k := range addrs {
+		if k > max {
+			max = k
+		}
+	}
+	out := make([]route.Addr, max+1)
+	for k, v := range addrs {
+		out[k] = v
+	}
+	return out
+}
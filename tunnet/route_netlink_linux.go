@@ -0,0 +1,240 @@
+// +build linux
+
+package tunnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+var rtSeqCounter int32
+
+// rtSeq returns a fresh, process-unique nlmsg_seq value so the kernel's
+// reply to our own request can be told apart from unrelated netlink
+// traffic on the socket.
+func rtSeq() uint32 {
+	return uint32(atomic.AddInt32(&rtSeqCounter, 1))
+}
+
+// addRoute and deleteRoute manage routes through an AF_NETLINK/
+// NETLINK_ROUTE socket (RTM_NEWROUTE/RTM_DELROUTE), the same mechanism
+// iproute2 and wireguard-go's linux backend use. listRoutes reads the
+// kernel's routing table back out via an RTM_GETROUTE dump.
+
+func addRoute(ifIndex int, dst *net.IPNet, gw net.IP) error {
+	flags := unix.NLM_F_REQUEST | unix.NLM_F_ACK | unix.NLM_F_CREATE | unix.NLM_F_EXCL
+	return sendRouteMessage(unix.RTM_NEWROUTE, flags, ifIndex, dst, gw)
+}
+
+func deleteRoute(ifIndex int, dst *net.IPNet, gw net.IP) error {
+	flags := unix.NLM_F_REQUEST | unix.NLM_F_ACK
+	return sendRouteMessage(unix.RTM_DELROUTE, flags, ifIndex, dst, gw)
+}
+
+func sendRouteMessage(typ, flags, ifIndex int, dst *net.IPNet, gw net.IP) error {
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+	if err := unix.Bind(sock, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	ones, _ := dst.Mask.Size()
+
+	rtmsg := make([]byte, unix.SizeofRtMsg)
+	rtmsg[0] = unix.AF_INET
+	rtmsg[1] = byte(ones) // rtm_dst_len
+	rtmsg[4] = unix.RT_TABLE_MAIN
+	rtmsg[5] = unix.RTPROT_BOOT
+	rtmsg[6] = unix.RT_SCOPE_UNIVERSE
+	if gw == nil {
+		rtmsg[6] = unix.RT_SCOPE_LINK
+	}
+	rtmsg[7] = unix.RTN_UNICAST
+
+	body := append(rtmsg, packRTAttr(unix.RTA_DST, dst.IP.To4())...)
+	body = append(body, packRTAttr(unix.RTA_OIF, packUint32(uint32(ifIndex)))...)
+	if gw != nil {
+		body = append(body, packRTAttr(unix.RTA_GATEWAY, gw.To4())...)
+	}
+
+	msg := packNlMsg(typ, flags, rtSeq(), body)
+	dest := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+	if err := unix.Sendto(sock, msg, 0, dest); err != nil {
+		return err
+	}
+	return readNetlinkAck(sock)
+}
+
+func listRoutes(ifIndex int) ([]Route, error) {
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(sock)
+	if err := unix.Bind(sock, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	rtgen := []byte{unix.AF_UNSPEC, 0, 0, 0}
+	flags := unix.NLM_F_REQUEST | unix.NLM_F_DUMP
+	msg := packNlMsg(unix.RTM_GETROUTE, flags, rtSeq(), rtgen)
+	dest := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+	if err := unix.Sendto(sock, msg, 0, dest); err != nil {
+		return nil, err
+	}
+
+	var routes []Route
+	buf := make([]byte, 65536)
+	for {
+		n, err := unix.Read(sock, buf)
+		if err != nil {
+			return nil, err
+		}
+		hdrs, bodies, done, err := parseNlMsgs(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for i, hdr := range hdrs {
+			if hdr.Type != unix.RTM_NEWROUTE || len(bodies[i]) < unix.SizeofRtMsg {
+				continue
+			}
+			if route, ok := parseRouteMsg(bodies[i], ifIndex); ok {
+				routes = append(routes, route)
+			}
+		}
+		if done {
+			return routes, nil
+		}
+	}
+}
+
+func parseRouteMsg(body []byte, ifIndex int) (Route, bool) {
+	dstLen := body[1]
+	attrs := parseRTAttrs(body[unix.SizeofRtMsg:])
+
+	var dst, gw net.IP
+	oif := -1
+	for typ, value := range attrs {
+		switch typ {
+		case unix.RTA_DST:
+			dst = net.IP(value)
+		case unix.RTA_GATEWAY:
+			gw = net.IP(value)
+		case unix.RTA_OIF:
+			oif = int(binary.LittleEndian.Uint32(value))
+		}
+	}
+	if oif != ifIndex || dst == nil {
+		return Route{}, false
+	}
+	return Route{
+		Dst:     &net.IPNet{IP: dst, Mask: net.CIDRMask(int(dstLen), len(dst)*8)},
+		Gateway: gw,
+	}, true
+}
+
+func readNetlinkAck(sock int) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.Read(sock, buf)
+		if err != nil {
+			return err
+		}
+		hdrs, bodies, done, err := parseNlMsgs(buf[:n])
+		if err != nil {
+			return err
+		}
+		for i, hdr := range hdrs {
+			if hdr.Type == unix.NLMSG_ERROR {
+				errno := int32(binary.LittleEndian.Uint32(bodies[i][:4]))
+				if errno == 0 {
+					return nil
+				}
+				return unix.Errno(-errno)
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// packNlMsg wraps body in an nlmsghdr, filling in nlmsg_len from body's
+// length. The kernel fills in nlmsg_pid itself when it's left as 0.
+func packNlMsg(typ, flags int, seq uint32, body []byte) []byte {
+	hdr := make([]byte, unix.SizeofNlMsghdr)
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.LittleEndian.PutUint16(hdr[4:6], uint16(typ))
+	binary.LittleEndian.PutUint16(hdr[6:8], uint16(flags))
+	binary.LittleEndian.PutUint32(hdr[8:12], seq)
+	return append(hdr, body...)
+}
+
+// parseNlMsgs splits buf into the nlmsghdrs and payloads it contains.
+// done reports whether the batch ended in NLMSG_DONE, meaning a dump
+// reader can stop issuing further reads.
+func parseNlMsgs(buf []byte) (hdrs []unix.NlMsghdr, bodies [][]byte, done bool, err error) {
+	for len(buf) >= unix.SizeofNlMsghdr {
+		var hdr unix.NlMsghdr
+		hdr.Len = binary.LittleEndian.Uint32(buf[0:4])
+		hdr.Type = binary.LittleEndian.Uint16(buf[4:6])
+		hdr.Flags = binary.LittleEndian.Uint16(buf[6:8])
+		hdr.Seq = binary.LittleEndian.Uint32(buf[8:12])
+		hdr.Pid = binary.LittleEndian.Uint32(buf[12:16])
+		if int(hdr.Len) < unix.SizeofNlMsghdr || int(hdr.Len) > len(buf) {
+			return nil, nil, false, errors.New("tunnet: malformed netlink message")
+		}
+		hdrs = append(hdrs, hdr)
+		bodies = append(bodies, buf[unix.SizeofNlMsghdr:hdr.Len])
+		if hdr.Type == unix.NLMSG_DONE {
+			done = true
+		}
+		buf = buf[align4(int(hdr.Len)):]
+	}
+	return hdrs, bodies, done, nil
+}
+
+// parseRTAttrs splits an rtattr chain into a type -> value map. Later
+// attributes of the same type overwrite earlier ones, which is the
+// Linux kernel's own convention for rtattr parsing.
+func parseRTAttrs(buf []byte) map[int][]byte {
+	attrs := make(map[int][]byte)
+	for len(buf) >= unix.SizeofRtAttr {
+		attrLen := int(binary.LittleEndian.Uint16(buf[0:2]))
+		attrType := int(binary.LittleEndian.Uint16(buf[2:4]))
+		if attrLen < unix.SizeofRtAttr || attrLen > len(buf) {
+			break
+		}
+		attrs[attrType] = buf[unix.SizeofRtAttr:attrLen]
+		buf = buf[align4(attrLen):]
+	}
+	return attrs
+}
+
+// packRTAttr builds a single rtattr (2-byte length, 2-byte type, then
+// the value), padded out to a 4-byte boundary as the kernel expects.
+func packRTAttr(attrType int, value []byte) []byte {
+	length := unix.SizeofRtAttr + len(value)
+	attr := make([]byte, align4(length))
+	binary.LittleEndian.PutUint16(attr[0:2], uint16(length))
+	binary.LittleEndian.PutUint16(attr[2:4], uint16(attrType))
+	copy(attr[unix.SizeofRtAttr:], value)
+	return attr
+}
+
+func packUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,58 @@
+// +build darwin
+
+package tunnet
+
+import (
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// rwCancel pairs a file descriptor with a self-pipe, inspired by
+// wireguard-go's rwcancel package. A goroutine blocked waiting for fd
+// to become ready can be woken up by closing the pipe's write end (via
+// cancel), without racing against a concurrent Close of fd itself.
+type rwCancel struct {
+	fd     int
+	writer *os.File
+	reader *os.File
+
+	closeLock sync.Mutex
+	closed    bool
+}
+
+func newRWCancel(fd int) (*rwCancel, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &rwCancel{fd: fd, writer: writer, reader: reader}, nil
+}
+
+// cancel wakes up any goroutine currently blocked in utunSocket.waitFD,
+// and makes later waits return at once. It is
+// idempotent and safe to call more than once.
+func (c *rwCancel) cancel() {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.writer.Close()
+}
+
+// close cancels any waiters and releases the pipe.
+func (c *rwCancel) close() {
+	c.cancel()
+	c.reader.Close()
+}
+
+func fdSet(set *unix.FdSet, fd int) {
+	set.Bits[fd/32] |= 1 << (uint(fd) % 32)
+}
+
+func fdIsSet(set *unix.FdSet, fd int) bool {
+	return set.Bits[fd/32]&(1<<(uint(fd)%32)) != 0
+}
@@ -0,0 +1,97 @@
+// Package tunnet provides a cross-platform abstraction over OS-level
+// tun network interfaces.
+package tunnet
+
+import "net"
+
+// Route is a single entry in a tunnel's routing table.
+type Route struct {
+	// Dst is the destination network the route applies to.
+	Dst *net.IPNet
+	// Gateway is the next hop, or nil for a directly-attached route.
+	Gateway net.IP
+}
+
+// Tunnel is a handle on a point-to-point tun network interface. All
+// platform-specific backends (darwin, freebsd, windows, ...) implement
+// this same interface, so callers of MakeTunnel don't need to branch on
+// GOOS.
+type Tunnel interface {
+	// Name returns the OS-assigned name of the interface, e.g. "utun0".
+	Name() string
+
+	// ReadPacket reads a single IP packet from the tunnel, blocking
+	// until one is available.
+	ReadPacket() (packet []byte, err error)
+
+	// WritePacket writes a single IP packet to the tunnel.
+	WritePacket(packet []byte) error
+
+	// ReadPackets reads one or more packets in a single call, copying
+	// each into the corresponding bufs[i] and recording its length in
+	// sizes[i]. It returns the number of packets read, which may be
+	// less than len(bufs) even when more are immediately available;
+	// callers after a specific count should call it in a loop.
+	// Backends that can't batch at the syscall level fall back to
+	// reading exactly one packet per call.
+	ReadPackets(bufs [][]byte, sizes []int) (n int, err error)
+
+	// WritePackets writes each of bufs as an independent packet and
+	// returns the number written before the first error, if any.
+	WritePackets(bufs [][]byte) (n int, err error)
+
+	// MTU returns the interface's current MTU.
+	MTU() (int, error)
+
+	// SetMTU changes the interface's MTU.
+	SetMTU(mtu int) error
+
+	// Addresses returns the point-to-point IPv4 addresses currently
+	// assigned to the tunnel.
+	Addresses() (local, dest net.IP, mask net.IPMask, err error)
+
+	// SetAddresses assigns a point-to-point IPv4 address to the
+	// tunnel.
+	SetAddresses(local, dest net.IP, mask net.IPMask) error
+
+	// AddRoute installs a route for dst via gw (or a direct route if gw
+	// is nil) through the tunnel, so callers no longer need to shell
+	// out to `route add`/`ip route` themselves.
+	AddRoute(dst *net.IPNet, gw net.IP) error
+
+	// DeleteRoute removes a route previously installed with AddRoute.
+	DeleteRoute(dst *net.IPNet, gw net.IP) error
+
+	// Routes lists the routes currently installed through the tunnel.
+	Routes() ([]Route, error)
+
+	// Close tears down the tunnel. Any in-flight ReadPacket or
+	// WritePacket calls are unblocked and return an error.
+	Close() error
+}
+
+// fallbackReadPackets implements ReadPackets for backends that can't
+// batch at the syscall level, by reading a single packet through t.
+func fallbackReadPackets(t Tunnel, bufs [][]byte, sizes []int) (n int, err error) {
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+	packet, err := t.ReadPacket()
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = copy(bufs[0], packet)
+	return 1, nil
+}
+
+// fallbackWritePackets implements WritePackets for backends that can't
+// batch at the syscall level, by writing each packet through t in turn.
+func fallbackWritePackets(t Tunnel, bufs [][]byte) (n int, err error) {
+	for _, buf := range bufs {
+		if err := t.WritePacket(buf); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
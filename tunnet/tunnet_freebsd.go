@@ -0,0 +1,261 @@
+// +build freebsd
+
+package tunnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"unsafe"
+
+	"github.com/unixpickle/essentials"
+
+	"golang.org/x/sys/unix"
+)
+
+const devTunPath = "/dev/tun"
+
+// ioctlTUNSIFHEAD is not exposed by golang.org/x/sys/unix; its value is
+// copied from sys/net/if_tun.h. It switches a tun fd into "multi-af"
+// mode, prefixing every packet with a 4-byte address family, matching
+// the framing utun already uses on darwin.
+const ioctlTUNSIFHEAD = 0x80047460
+
+// MakeTunnel creates a new tunnel interface.
+func MakeTunnel() (Tunnel, error) {
+	tun, err := openFreeBSDTunnel()
+	err = essentials.AddCtx("make tunnel", err)
+	return tun, err
+}
+
+type freebsdTunnel struct {
+	fd   int
+	name string
+
+	refLock  sync.Mutex
+	refCount int
+	closed   bool
+}
+
+func openFreeBSDTunnel() (res *freebsdTunnel, err error) {
+	var fd int
+	var name string
+	for i := 0; i < 256; i++ {
+		fd, err = unix.Open(devTunPath+strconv.Itoa(i), unix.O_RDWR, 0)
+		if err == nil {
+			name = "tun" + strconv.Itoa(i)
+			break
+		} else if err != unix.EBUSY {
+			return nil, err
+		}
+	}
+	if name == "" {
+		return nil, errors.New("no free /dev/tunN device")
+	}
+	tun := &freebsdTunnel{fd: fd, name: name}
+
+	defer func() {
+		if err != nil {
+			unix.Close(tun.fd)
+		}
+	}()
+
+	one := 1
+	if _, _, sysErr := unix.Syscall(unix.SYS_IOCTL, uintptr(tun.fd), uintptr(ioctlTUNSIFHEAD),
+		uintptr(unsafe.Pointer(&one))); sysErr != 0 {
+		return nil, sysErr
+	}
+
+	return tun, nil
+}
+
+func (u *freebsdTunnel) Name() string {
+	return u.name
+}
+
+func (u *freebsdTunnel) ReadPacket() (packet []byte, err error) {
+	defer essentials.AddCtxTo("read packet", &err)
+	if err := u.retain(); err != nil {
+		return nil, err
+	}
+	defer u.release()
+	buffer := make([]byte, 65536)
+	for {
+		amount, err := unix.Read(u.fd, buffer)
+		if err == nil {
+			return buffer[4:amount], nil
+		} else if err == unix.EINTR {
+			continue
+		} else {
+			return nil, err
+		}
+	}
+}
+
+func (u *freebsdTunnel) WritePacket(buffer []byte) (err error) {
+	defer essentials.AddCtxTo("write packet", &err)
+	if err := u.retain(); err != nil {
+		return err
+	}
+	defer u.release()
+	family := unix.AF_INET
+	if len(buffer) > 0 && buffer[0]>>4 == 6 {
+		family = unix.AF_INET6
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(family))
+	_, err = unix.Write(u.fd, append(header, buffer...))
+	return err
+}
+
+// ReadPackets falls back to one read(2) per packet; /dev/tun doesn't
+// support batching multiple packets into a single syscall.
+func (u *freebsdTunnel) ReadPackets(bufs [][]byte, sizes []int) (int, error) {
+	return fallbackReadPackets(u, bufs, sizes)
+}
+
+// WritePackets falls back to one write(2) per packet.
+func (u *freebsdTunnel) WritePackets(bufs [][]byte) (int, error) {
+	return fallbackWritePackets(u, bufs)
+}
+
+func (u *freebsdTunnel) MTU() (mtu int, err error) {
+	defer essentials.AddCtxTo("get MTU", &err)
+	buf := make([]byte, 4)
+	if err := u.ifreqIOCTL(ioctlSIOCGIFMTU, buf); err != nil {
+		return 0, err
+	}
+	var value uint32
+	binary.Read(bytes.NewReader(buf), systemByteOrder, &value)
+	return int(value), nil
+}
+
+func (u *freebsdTunnel) SetMTU(mtu int) (err error) {
+	defer essentials.AddCtxTo("set MTU", &err)
+	var buf bytes.Buffer
+	binary.Write(&buf, systemByteOrder, uint32(mtu))
+	return u.ifreqIOCTL(ioctlSIOCSIFMTU, buf.Bytes())
+}
+
+func (u *freebsdTunnel) Addresses() (local, dest net.IP, mask net.IPMask, err error) {
+	defer essentials.AddCtxTo("get addresses", &err)
+
+	sockaddrOut := packSockaddr4(net.IPv4zero, 0)
+
+	ips := []net.IP{}
+	ioctls := []int{ioctlSIOCGIFADDR, ioctlSIOCGIFDSTADDR, ioctlSIOCGIFNETMASK}
+	for _, ioctl := range ioctls {
+		if err := u.ifreqIOCTL(ioctl, sockaddrOut); err != nil {
+			return nil, nil, nil, err
+		}
+		ip, _ := unpackSockaddr4(sockaddrOut)
+		ips = append(ips, ip)
+	}
+	return ips[0], ips[1], net.IPMask(ips[2]), nil
+}
+
+func (u *freebsdTunnel) SetAddresses(local, dest net.IP, mask net.IPMask) (err error) {
+	defer essentials.AddCtxTo("set addresses", &err)
+
+	if local.To4() == nil || dest.To4() == nil || len(mask) != 4 {
+		return errors.New("only IPv4 is supported")
+	}
+
+	u.ifreqIOCTL(ioctlSIOCDIFADDR, make([]byte, 16*3))
+
+	var sockaddrs bytes.Buffer
+	for _, ip := range []net.IP{local, dest, net.IP(mask)} {
+		sockaddrs.Write(packSockaddr4(ip, 0))
+	}
+	if err := u.ifreqIOCTL(ioctlSIOCAIFADDR, sockaddrs.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddRoute installs a route for dst via gw (or a direct route if gw is
+// nil) through the tunnel, via a PF_ROUTE socket.
+func (u *freebsdTunnel) AddRoute(dst *net.IPNet, gw net.IP) (err error) {
+	defer essentials.AddCtxTo("add route", &err)
+	iface, err := net.InterfaceByName(u.Name())
+	if err != nil {
+		return err
+	}
+	return addRoute(iface.Index, dst, gw)
+}
+
+// DeleteRoute removes a route previously installed with AddRoute.
+func (u *freebsdTunnel) DeleteRoute(dst *net.IPNet, gw net.IP) (err error) {
+	defer essentials.AddCtxTo("delete route", &err)
+	iface, err := net.InterfaceByName(u.Name())
+	if err != nil {
+		return err
+	}
+	return deleteRoute(iface.Index, dst, gw)
+}
+
+// Routes lists the routes currently installed through the tunnel.
+func (u *freebsdTunnel) Routes() (routes []Route, err error) {
+	defer essentials.AddCtxTo("list routes", &err)
+	iface, err := net.InterfaceByName(u.Name())
+	if err != nil {
+		return nil, err
+	}
+	return listRoutes(iface.Index)
+}
+
+func (u *freebsdTunnel) Close() (err error) {
+	defer essentials.AddCtxTo("close", &err)
+	if err := u.retain(); err != nil {
+		return err
+	}
+	defer u.release()
+	return unix.Close(u.fd)
+}
+
+func (u *freebsdTunnel) ifreqIOCTL(ioctl int, reqData []byte) error {
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+
+	var ifreq []byte
+	if len(reqData) > 16 {
+		ifreq = make([]byte, 16+len(reqData))
+	} else {
+		ifreq = make([]byte, 32)
+	}
+	copy(ifreq[:16], []byte(u.Name()))
+	copy(ifreq[16:], reqData)
+	_, _, sysErr := unix.Syscall(unix.SYS_IOCTL, uintptr(sock), uintptr(ioctl),
+		uintptr(unsafe.Pointer(&ifreq[0])))
+	copy(reqData, ifreq[16:])
+	if sysErr == 0 {
+		return nil
+	}
+	return sysErr
+}
+
+func (u *freebsdTunnel) retain() error {
+	u.refLock.Lock()
+	defer u.refLock.Unlock()
+	if u.closed {
+		return os.ErrClosed
+	}
+	u.refCount += 1
+	return nil
+}
+
+func (u *freebsdTunnel) release() {
+	u.refLock.Lock()
+	defer u.refLock.Unlock()
+	u.refCount -= 1
+	if u.closed && u.refCount == 0 {
+		unix.Close(u.fd)
+	}
+}
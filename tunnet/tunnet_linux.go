@@ -0,0 +1,280 @@
+// +build linux
+
+package tunnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/unixpickle/essentials"
+
+	"golang.org/x/sys/unix"
+)
+
+const devNetTun = "/dev/net/tun"
+
+// MakeTunnel creates a new tunnel interface.
+func MakeTunnel() (Tunnel, error) {
+	tun, err := openLinuxTunnel()
+	err = essentials.AddCtx("make tunnel", err)
+	return tun, err
+}
+
+type linuxTunnel struct {
+	fd   int
+	name string
+
+	refLock  sync.Mutex
+	refCount int
+	closed   bool
+}
+
+func openLinuxTunnel() (res *linuxTunnel, err error) {
+	fd, err := unix.Open(devNetTun, unix.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	tun := &linuxTunnel{fd: fd}
+
+	defer func() {
+		if err != nil {
+			unix.Close(tun.fd)
+		}
+	}()
+
+	// struct ifreq for TUNSETIFF: a 16-byte name followed by a 2-byte
+	// flags field, padded out to the kernel's full ifreq size (40 bytes
+	// on 64-bit Linux).
+	ifr := make([]byte, 40)
+	binary.LittleEndian.PutUint16(ifr[unix.IFNAMSIZ:], unix.IFF_TUN|unix.IFF_NO_PI)
+	if _, _, sysErr := unix.Syscall(unix.SYS_IOCTL, uintptr(tun.fd), uintptr(unix.TUNSETIFF),
+		uintptr(unsafe.Pointer(&ifr[0]))); sysErr != 0 {
+		return nil, sysErr
+	}
+	tun.name = string(bytes.TrimRight(ifr[:unix.IFNAMSIZ], "\x00"))
+
+	return tun, nil
+}
+
+func (u *linuxTunnel) Name() string {
+	return u.name
+}
+
+// ReadPacket reads a single IP packet. Opened with IFF_NO_PI, so unlike
+// utun/freebsd's /dev/tun, the kernel doesn't prefix packets with an
+// address-family header here.
+func (u *linuxTunnel) ReadPacket() (packet []byte, err error) {
+	defer essentials.AddCtxTo("read packet", &err)
+	if err := u.retain(); err != nil {
+		return nil, err
+	}
+	defer u.release()
+	buffer := make([]byte, 65536)
+	for {
+		amount, err := unix.Read(u.fd, buffer)
+		if err == nil {
+			return buffer[:amount], nil
+		} else if err == unix.EINTR {
+			continue
+		} else {
+			return nil, err
+		}
+	}
+}
+
+func (u *linuxTunnel) WritePacket(buffer []byte) (err error) {
+	defer essentials.AddCtxTo("write packet", &err)
+	if err := u.retain(); err != nil {
+		return err
+	}
+	defer u.release()
+	for {
+		_, err := unix.Write(u.fd, buffer)
+		if err == nil {
+			return nil
+		} else if err == unix.EINTR {
+			continue
+		} else {
+			return err
+		}
+	}
+}
+
+// ReadPackets falls back to one read(2) per packet; plain IFF_NO_PI tun
+// fds don't support batching multiple packets into a single syscall
+// (that needs IFF_VNET_HDR framing, which this backend doesn't use).
+func (u *linuxTunnel) ReadPackets(bufs [][]byte, sizes []int) (int, error) {
+	return fallbackReadPackets(u, bufs, sizes)
+}
+
+// WritePackets falls back to one write(2) per packet.
+func (u *linuxTunnel) WritePackets(bufs [][]byte) (int, error) {
+	return fallbackWritePackets(u, bufs)
+}
+
+func (u *linuxTunnel) MTU() (mtu int, err error) {
+	defer essentials.AddCtxTo("get MTU", &err)
+	buf := make([]byte, 4)
+	if err := u.ifreqIOCTL(unix.SIOCGIFMTU, buf); err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint32(buf)), nil
+}
+
+func (u *linuxTunnel) SetMTU(mtu int) (err error) {
+	defer essentials.AddCtxTo("set MTU", &err)
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(mtu))
+	return u.ifreqIOCTL(unix.SIOCSIFMTU, buf)
+}
+
+func (u *linuxTunnel) Addresses() (local, dest net.IP, mask net.IPMask, err error) {
+	defer essentials.AddCtxTo("get addresses", &err)
+
+	localBuf := packSockaddrIn(net.IPv4zero)
+	if err := u.ifreqIOCTL(unix.SIOCGIFADDR, localBuf); err != nil {
+		return nil, nil, nil, err
+	}
+	destBuf := packSockaddrIn(net.IPv4zero)
+	if err := u.ifreqIOCTL(unix.SIOCGIFDSTADDR, destBuf); err != nil {
+		return nil, nil, nil, err
+	}
+	maskBuf := packSockaddrIn(net.IPv4zero)
+	if err := u.ifreqIOCTL(unix.SIOCGIFNETMASK, maskBuf); err != nil {
+		return nil, nil, nil, err
+	}
+	return unpackSockaddrIn(localBuf), unpackSockaddrIn(destBuf),
+		net.IPMask(unpackSockaddrIn(maskBuf)), nil
+}
+
+func (u *linuxTunnel) SetAddresses(local, dest net.IP, mask net.IPMask) (err error) {
+	defer essentials.AddCtxTo("set addresses", &err)
+
+	if local.To4() == nil || dest.To4() == nil || len(mask) != 4 {
+		return errors.New("only IPv4 is supported")
+	}
+
+	if err := u.ifreqIOCTL(unix.SIOCSIFADDR, packSockaddrIn(local)); err != nil {
+		return err
+	}
+	if err := u.ifreqIOCTL(unix.SIOCSIFDSTADDR, packSockaddrIn(dest)); err != nil {
+		return err
+	}
+	if err := u.ifreqIOCTL(unix.SIOCSIFNETMASK, packSockaddrIn(net.IP(mask))); err != nil {
+		return err
+	}
+
+	// Unlike utun on darwin, a fresh Linux tun interface comes up
+	// administratively down, so it won't pass traffic until IFF_UP is
+	// set explicitly.
+	flagsBuf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(flagsBuf, unix.IFF_UP|unix.IFF_RUNNING)
+	return u.ifreqIOCTL(unix.SIOCSIFFLAGS, flagsBuf)
+}
+
+// AddRoute installs a route for dst via gw (or a direct route if gw is
+// nil) through the tunnel, via an AF_NETLINK/RTM_NEWROUTE socket.
+func (u *linuxTunnel) AddRoute(dst *net.IPNet, gw net.IP) (err error) {
+	defer essentials.AddCtxTo("add route", &err)
+	iface, err := net.InterfaceByName(u.Name())
+	if err != nil {
+		return err
+	}
+	return addRoute(iface.Index, dst, gw)
+}
+
+// DeleteRoute removes a route previously installed with AddRoute.
+func (u *linuxTunnel) DeleteRoute(dst *net.IPNet, gw net.IP) (err error) {
+	defer essentials.AddCtxTo("delete route", &err)
+	iface, err := net.InterfaceByName(u.Name())
+	if err != nil {
+		return err
+	}
+	return deleteRoute(iface.Index, dst, gw)
+}
+
+// Routes lists the routes currently installed through the tunnel.
+func (u *linuxTunnel) Routes() (routes []Route, err error) {
+	defer essentials.AddCtxTo("list routes", &err)
+	iface, err := net.InterfaceByName(u.Name())
+	if err != nil {
+		return nil, err
+	}
+	return listRoutes(iface.Index)
+}
+
+func (u *linuxTunnel) Close() (err error) {
+	defer essentials.AddCtxTo("close", &err)
+	if err := u.retain(); err != nil {
+		return err
+	}
+	defer u.release()
+	return unix.Close(u.fd)
+}
+
+func (u *linuxTunnel) ifreqIOCTL(ioctl int, reqData []byte) error {
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+
+	var ifreq []byte
+	if len(reqData) > 16 {
+		ifreq = make([]byte, 16+len(reqData))
+	} else {
+		ifreq = make([]byte, 32)
+	}
+	copy(ifreq[:16], []byte(u.Name()))
+	copy(ifreq[16:], reqData)
+	_, _, sysErr := unix.Syscall(unix.SYS_IOCTL, uintptr(sock), uintptr(ioctl),
+		uintptr(unsafe.Pointer(&ifreq[0])))
+	copy(reqData, ifreq[16:])
+	if sysErr == 0 {
+		return nil
+	}
+	return sysErr
+}
+
+// packSockaddrIn and unpackSockaddrIn pack/unpack the struct sockaddr_in
+// that SIOC[GS]IF{ADDR,DSTADDR,NETMASK} read and write through
+// ifr_addr: a 2-byte family, 2-byte port, and 4-byte IPv4 address,
+// padded out to sizeof(struct sockaddr) (16 bytes).
+func packSockaddrIn(ip net.IP) []byte {
+	sa := make([]byte, 16)
+	binary.LittleEndian.PutUint16(sa[0:2], unix.AF_INET)
+	ip4 := ip.To4()
+	if ip4 == nil {
+		ip4 = net.IPv4zero.To4()
+	}
+	copy(sa[4:8], ip4)
+	return sa
+}
+
+func unpackSockaddrIn(sa []byte) net.IP {
+	return net.IP(append([]byte{}, sa[4:8]...))
+}
+
+func (u *linuxTunnel) retain() error {
+	u.refLock.Lock()
+	defer u.refLock.Unlock()
+	if u.closed {
+		return os.ErrClosed
+	}
+	u.refCount += 1
+	return nil
+}
+
+func (u *linuxTunnel) release() {
+	u.refLock.Lock()
+	defer u.refLock.Unlock()
+	u.refCount -= 1
+	if u.closed && u.refCount == 0 {
+		unix.Close(u.fd)
+	}
+}
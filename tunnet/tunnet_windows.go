@@ -0,0 +1,257 @@
+// +build windows
+
+package tunnet
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wintun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+const wintunTunnelType = "learnet"
+
+// MakeTunnel creates a new tunnel interface.
+func MakeTunnel() (Tunnel, error) {
+	tun, err := openWintunTunnel()
+	err = essentials.AddCtx("make tunnel", err)
+	return tun, err
+}
+
+type wintunTunnel struct {
+	adapter *wintun.Adapter
+	session wintun.Session
+
+	closeLock sync.Mutex
+	closed    bool
+}
+
+func openWintunTunnel() (res *wintunTunnel, err error) {
+	adapter, err := wintun.CreateAdapter(wintunTunnelType, wintunTunnelType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			adapter.Close()
+		}
+	}()
+
+	// 0x400000 is the session's ring capacity in bytes (4 MiB), which
+	// bounds how much can queue up before ReadPacket drains it.
+	session, err := adapter.StartSession(0x400000)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wintunTunnel{adapter: adapter, session: session}, nil
+}
+
+func (u *wintunTunnel) Name() string {
+	iface, err := u.luid().Interface()
+	if err != nil {
+		return ""
+	}
+	return iface.Alias()
+}
+
+func (u *wintunTunnel) ReadPacket() (packet []byte, err error) {
+	defer essentials.AddCtxTo("read packet", &err)
+	for {
+		data, err := u.session.ReceivePacket()
+		if err == nil {
+			out := append([]byte{}, data...)
+			u.session.ReleaseReceivePacket(data)
+			return out, nil
+		} else if err == windows.ERROR_NO_MORE_ITEMS {
+			if _, waitErr := windows.WaitForSingleObject(u.session.ReadWaitEvent(), windows.INFINITE); waitErr != nil {
+				return nil, waitErr
+			}
+			continue
+		} else {
+			return nil, err
+		}
+	}
+}
+
+func (u *wintunTunnel) WritePacket(buffer []byte) (err error) {
+	defer essentials.AddCtxTo("write packet", &err)
+	packet, err := u.session.AllocateSendPacket(len(buffer))
+	if err != nil {
+		return err
+	}
+	copy(packet, buffer)
+	u.session.SendPacket(packet)
+	return nil
+}
+
+// ReadPackets falls back to one ReceivePacket call per packet; Wintun's
+// Go bindings don't expose a way to batch several into one call.
+func (u *wintunTunnel) ReadPackets(bufs [][]byte, sizes []int) (int, error) {
+	return fallbackReadPackets(u, bufs, sizes)
+}
+
+// WritePackets falls back to one SendPacket call per packet.
+func (u *wintunTunnel) WritePackets(bufs [][]byte) (int, error) {
+	return fallbackWritePackets(u, bufs)
+}
+
+func (u *wintunTunnel) MTU() (mtu int, err error) {
+	defer essentials.AddCtxTo("get MTU", &err)
+	iface, err := u.luid().IPInterface(windows.AF_INET)
+	if err != nil {
+		return 0, err
+	}
+	return int(iface.NLMTU), nil
+}
+
+func (u *wintunTunnel) SetMTU(mtu int) (err error) {
+	defer essentials.AddCtxTo("set MTU", &err)
+	iface, err := u.luid().IPInterface(windows.AF_INET)
+	if err != nil {
+		return err
+	}
+	iface.NLMTU = uint32(mtu)
+	return iface.Set()
+}
+
+func (u *wintunTunnel) Addresses() (local, dest net.IP, mask net.IPMask, err error) {
+	defer essentials.AddCtxTo("get addresses", &err)
+	rows, err := winipcfg.GetUnicastIPAddressTable(windows.AF_INET)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	luid := u.luid()
+	for _, row := range rows {
+		if row.InterfaceLUID != luid {
+			continue
+		}
+		ip := net.IP(row.Address.Addr().AsSlice())
+		return ip, ip, net.CIDRMask(int(row.OnLinkPrefixLength), 32), nil
+	}
+	return nil, nil, nil, errors.New("no IPv4 address assigned")
+}
+
+// SetAddresses assigns local as the tunnel's IPv4 address, with the
+// prefix length taken from mask. Wintun interfaces aren't truly
+// point-to-point, so dest is ignored.
+func (u *wintunTunnel) SetAddresses(local, dest net.IP, mask net.IPMask) (err error) {
+	defer essentials.AddCtxTo("set addresses", &err)
+
+	if local.To4() == nil || len(mask) != 4 {
+		return errors.New("only IPv4 is supported")
+	}
+
+	ones, _ := mask.Size()
+	addr, ok := netip.AddrFromSlice(local.To4())
+	if !ok {
+		return errors.New("invalid IPv4 address")
+	}
+	return u.luid().SetIPAddressesForFamily(windows.AF_INET, []netip.Prefix{
+		netip.PrefixFrom(addr, ones),
+	})
+}
+
+// AddRoute installs a route for dst via gw (or a direct route if gw is
+// nil) through the tunnel, via the IP Helper API.
+func (u *wintunTunnel) AddRoute(dst *net.IPNet, gw net.IP) (err error) {
+	defer essentials.AddCtxTo("add route", &err)
+	prefix, nextHop, err := toRoutePrefixAndHop(dst, gw)
+	if err != nil {
+		return err
+	}
+	return u.luid().AddRoute(prefix, nextHop, 0)
+}
+
+// DeleteRoute removes a route previously installed with AddRoute.
+func (u *wintunTunnel) DeleteRoute(dst *net.IPNet, gw net.IP) (err error) {
+	defer essentials.AddCtxTo("delete route", &err)
+	prefix, nextHop, err := toRoutePrefixAndHop(dst, gw)
+	if err != nil {
+		return err
+	}
+	return u.luid().DeleteRoute(prefix, nextHop)
+}
+
+// Routes lists the routes currently installed through the tunnel.
+func (u *wintunTunnel) Routes() (routes []Route, err error) {
+	defer essentials.AddCtxTo("list routes", &err)
+	rows, err := winipcfg.GetIPForwardTable2(windows.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	luid := u.luid()
+	for _, row := range rows {
+		if row.InterfaceLUID != luid {
+			continue
+		}
+		prefix := row.DestinationPrefix.Prefix()
+		var gw net.IP
+		if hop := row.NextHop.Addr(); hop.IsValid() && !hop.IsUnspecified() {
+			gw = net.IP(hop.AsSlice())
+		}
+		routes = append(routes, Route{
+			Dst:     netIPNetFromPrefix(prefix),
+			Gateway: gw,
+		})
+	}
+	return routes, nil
+}
+
+// toRoutePrefixAndHop converts the net.IPNet/net.IP pair used by the
+// Tunnel interface into the netip types winipcfg's LUID route methods
+// take. A nil gw becomes the zero Addr, which winipcfg treats as "no
+// next hop" (an on-link route).
+func toRoutePrefixAndHop(dst *net.IPNet, gw net.IP) (netip.Prefix, netip.Addr, error) {
+	ones, _ := dst.Mask.Size()
+	dstAddr, ok := netip.AddrFromSlice(dst.IP.To4())
+	if !ok {
+		dstAddr, ok = netip.AddrFromSlice(dst.IP.To16())
+	}
+	if !ok {
+		return netip.Prefix{}, netip.Addr{}, errors.New("invalid destination address")
+	}
+	prefix := netip.PrefixFrom(dstAddr, ones)
+
+	if gw == nil {
+		return prefix, netip.Addr{}, nil
+	}
+	nextHop, ok := netip.AddrFromSlice(gw.To4())
+	if !ok {
+		nextHop, ok = netip.AddrFromSlice(gw.To16())
+	}
+	if !ok {
+		return netip.Prefix{}, netip.Addr{}, errors.New("invalid gateway address")
+	}
+	return prefix, nextHop, nil
+}
+
+func netIPNetFromPrefix(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   net.IP(prefix.Addr().AsSlice()),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
+func (u *wintunTunnel) Close() (err error) {
+	defer essentials.AddCtxTo("close", &err)
+	u.closeLock.Lock()
+	defer u.closeLock.Unlock()
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+	u.session.End()
+	return u.adapter.Close()
+}
+
+func (u *wintunTunnel) luid() winipcfg.LUID {
+	return winipcfg.LUID(u.adapter.LUID())
+}
@@ -0,0 +1,52 @@
+// +build windows
+
+package tunnet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestToRoutePrefixAndHop(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.0.0.0/24")
+	gw := net.ParseIP("10.0.0.1")
+
+	prefix, nextHop, err := toRoutePrefixAndHop(dst, gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix.String() != "10.0.0.0/24" {
+		t.Errorf("expected prefix 10.0.0.0/24, got %s", prefix)
+	}
+	if nextHop.String() != "10.0.0.1" {
+		t.Errorf("expected next hop 10.0.0.1, got %s", nextHop)
+	}
+}
+
+func TestToRoutePrefixAndHopNilGateway(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.0.0.0/24")
+
+	prefix, nextHop, err := toRoutePrefixAndHop(dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix.String() != "10.0.0.0/24" {
+		t.Errorf("expected prefix 10.0.0.0/24, got %s", prefix)
+	}
+	if nextHop.IsValid() {
+		t.Errorf("expected zero Addr for nil gateway, got %s", nextHop)
+	}
+}
+
+func TestNetIPNetFromPrefix(t *testing.T) {
+	_, want, _ := net.ParseCIDR("10.0.0.0/24")
+
+	prefix, _, err := toRoutePrefixAndHop(want, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := netIPNetFromPrefix(prefix)
+	if got.String() != want.String() {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
@@ -4,11 +4,13 @@ package tunnet
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"net"
 	"os"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/unixpickle/essentials"
@@ -21,6 +23,19 @@ const (
 	utunControl   = "com.apple.net.utun_control"
 )
 
+const (
+	afInet  = 2
+	afInet6 = 30
+)
+
+// ioctlSIOCPROTOATTACH_IN6 and ioctlSIOCAIFADDR_IN6 are not exposed by
+// golang.org/x/sys/unix, so their numeric values are copied from the
+// macOS SDK's bsd/netinet6/in6_var.h.
+const (
+	ioctlSIOCPROTOATTACH_IN6 = 0xc0986985
+	ioctlSIOCAIFADDR_IN6     = 0x8080691a
+)
+
 // MakeTunnel creates a new tunnel interface.
 func MakeTunnel() (Tunnel, error) {
 	tun, err := openUtunSocket()
@@ -35,6 +50,12 @@ type utunSocket struct {
 	refLock  sync.Mutex
 	refCount int
 	closed   bool
+
+	cancel *rwCancel
+
+	deadlineLock  sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
 }
 
 func openUtunSocket() (res *utunSocket, err error) {
@@ -47,6 +68,9 @@ func openUtunSocket() (res *utunSocket, err error) {
 	defer func() {
 		if err != nil {
 			unix.Close(socket.fd)
+			if socket.cancel != nil {
+				socket.cancel.close()
+			}
 		}
 	}()
 
@@ -69,6 +93,17 @@ func openUtunSocket() (res *utunSocket, err error) {
 
 	socket.name = string(nameData[:nameLen-1])
 
+	// Put the fd in non-blocking mode so that reads and writes go
+	// through the select loop in waitFD below, which is what lets
+	// ReadPacketContext and the deadline setters interrupt them.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return nil, err
+	}
+	socket.cancel, err = newRWCancel(fd)
+	if err != nil {
+		return nil, err
+	}
+
 	return socket, nil
 }
 
@@ -77,20 +112,45 @@ func (u *utunSocket) Name() string {
 }
 
 func (u *utunSocket) ReadPacket() (packet []byte, err error) {
+	packet, _, err = u.ReadPacketFamily()
+	return packet, err
+}
+
+// ReadPacketFamily is like ReadPacket, but also returns the address
+// family (afInet or afInet6) that the utun header reported for the
+// packet, rather than silently discarding it.
+func (u *utunSocket) ReadPacketFamily() (packet []byte, family int, err error) {
+	return u.readPacketFamily(context.Background())
+}
+
+// ReadPacketContext is like ReadPacket, but returns ctx.Err() if ctx is
+// canceled, or its deadline passes, before a packet arrives. This lets
+// a caller interrupt a blocking read from another goroutine without
+// tearing down the tunnel via Close.
+func (u *utunSocket) ReadPacketContext(ctx context.Context) (packet []byte, err error) {
+	packet, _, err = u.readPacketFamily(ctx)
+	return packet, err
+}
+
+func (u *utunSocket) readPacketFamily(ctx context.Context) (packet []byte, family int, err error) {
 	defer essentials.AddCtxTo("read packet", &err)
 	if err := u.retain(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer u.release()
-	packet = make([]byte, 65536)
+	buffer := make([]byte, 65536)
 	for {
-		amount, err := unix.Read(u.fd, packet)
+		if err := u.waitFD(ctx, false, u.getReadDeadline()); err != nil {
+			return nil, 0, err
+		}
+		amount, err := unix.Read(u.fd, buffer)
 		if err == nil {
-			return packet[4:amount], nil
-		} else if err == unix.EINTR {
+			family = int(binary.BigEndian.Uint32(buffer[:4]))
+			return buffer[4:amount], family, nil
+		} else if err == unix.EINTR || err == unix.EAGAIN {
 			continue
 		} else {
-			return nil, err
+			return nil, 0, err
 		}
 	}
 }
@@ -101,8 +161,246 @@ func (u *utunSocket) WritePacket(buffer []byte) (err error) {
 		return err
 	}
 	defer u.release()
-	_, err = unix.Write(u.fd, append([]byte{0, 0, 0, 2}, buffer...))
-	return err
+	family := afInet
+	if ipPacketVersion(buffer) == 6 {
+		family = afInet6
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(family))
+	packet := append(header, buffer...)
+	for {
+		if err := u.waitFD(context.Background(), true, u.getWriteDeadline()); err != nil {
+			return err
+		}
+		_, err := unix.Write(u.fd, packet)
+		if err == nil {
+			return nil
+		} else if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		} else {
+			return err
+		}
+	}
+}
+
+// ReadPackets reads a single packet using readv, writing the family
+// header into a scratch buffer and the payload directly into bufs[0],
+// so callers that supply a buffer pool avoid the extra allocation and
+// copy ReadPacket needs. It always reads exactly one packet per call:
+// utun is a character device, and one read (or readv) only ever
+// returns one packet no matter how many iovecs are given.
+func (u *utunSocket) ReadPackets(bufs [][]byte, sizes []int) (n int, err error) {
+	defer essentials.AddCtxTo("read packets", &err)
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+	if err := u.retain(); err != nil {
+		return 0, err
+	}
+	defer u.release()
+
+	header := make([]byte, 4)
+	for {
+		if err := u.waitFD(context.Background(), false, u.getReadDeadline()); err != nil {
+			return 0, err
+		}
+		amount, err := readv(u.fd, [][]byte{header, bufs[0]})
+		if err == nil {
+			sizes[0] = amount - len(header)
+			return 1, nil
+		} else if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		} else {
+			return 0, err
+		}
+	}
+}
+
+// WritePackets writes each of bufs as its own packet using writev, so
+// the family header and the caller's payload reach the kernel in a
+// single syscall without first being concatenated into a new slice.
+// It returns the number of packets written before the first error, if
+// any.
+func (u *utunSocket) WritePackets(bufs [][]byte) (n int, err error) {
+	defer essentials.AddCtxTo("write packets", &err)
+	if err := u.retain(); err != nil {
+		return 0, err
+	}
+	defer u.release()
+
+	for _, buf := range bufs {
+		family := afInet
+		if ipPacketVersion(buf) == 6 {
+			family = afInet6
+		}
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(family))
+
+		for {
+			if err := u.waitFD(context.Background(), true, u.getWriteDeadline()); err != nil {
+				return n, err
+			}
+			_, err := writev(u.fd, [][]byte{header, buf})
+			if err == nil {
+				break
+			} else if err == unix.EINTR || err == unix.EAGAIN {
+				continue
+			} else {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// readv and writev issue SYS_READV/SYS_WRITEV directly via unix.Syscall,
+// the same way ifreqIOCTL and friends already issue unwrapped syscalls
+// on darwin below. golang.org/x/sys/unix doesn't export Readv/Writev
+// wrappers for darwin (only linux and illumos get those), but the
+// syscall numbers and the unix.Iovec type it packs are both present, so
+// there's no need to give up vectorized I/O here.
+func readv(fd int, bufs [][]byte) (int, error) {
+	iovecs := toIovecs(bufs)
+	amount, _, sysErr := unix.Syscall(unix.SYS_READV, uintptr(fd),
+		uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	if sysErr != 0 {
+		return 0, sysErr
+	}
+	return int(amount), nil
+}
+
+func writev(fd int, bufs [][]byte) (int, error) {
+	iovecs := toIovecs(bufs)
+	amount, _, sysErr := unix.Syscall(unix.SYS_WRITEV, uintptr(fd),
+		uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	if sysErr != 0 {
+		return 0, sysErr
+	}
+	return int(amount), nil
+}
+
+func toIovecs(bufs [][]byte) []unix.Iovec {
+	iovecs := make([]unix.Iovec, len(bufs))
+	for i, buf := range bufs {
+		if len(buf) == 0 {
+			continue
+		}
+		iovecs[i].Base = &buf[0]
+		iovecs[i].SetLen(len(buf))
+	}
+	return iovecs
+}
+
+// SetReadDeadline causes later ReadPacket, ReadPacketFamily,
+// ReadPacketContext and ReadPackets calls to fail with
+// os.ErrDeadlineExceeded once t passes. A zero t disables the deadline.
+// A call that is already blocked keeps waiting under the deadline that
+// was in effect when it started to wait; setting a new one doesn't wake it.
+func (u *utunSocket) SetReadDeadline(t time.Time) error {
+	u.deadlineLock.Lock()
+	defer u.deadlineLock.Unlock()
+	u.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline is the WritePacket analog of SetReadDeadline.
+func (u *utunSocket) SetWriteDeadline(t time.Time) error {
+	u.deadlineLock.Lock()
+	defer u.deadlineLock.Unlock()
+	u.writeDeadline = t
+	return nil
+}
+
+func (u *utunSocket) getReadDeadline() time.Time {
+	u.deadlineLock.Lock()
+	defer u.deadlineLock.Unlock()
+	return u.readDeadline
+}
+
+func (u *utunSocket) getWriteDeadline() time.Time {
+	u.deadlineLock.Lock()
+	defer u.deadlineLock.Unlock()
+	return u.writeDeadline
+}
+
+// waitFD blocks until u.fd is ready for reading (or writing, if write
+// is true), ctx is done, deadline passes, or u.cancel is canceled.
+func (u *utunSocket) waitFD(ctx context.Context, write bool, deadline time.Time) error {
+	cancelFd := int(u.cancel.reader.Fd())
+	maxFd := u.fd
+	if cancelFd > maxFd {
+		maxFd = cancelFd
+	}
+	for {
+		rfds := &unix.FdSet{}
+		fdSet(rfds, cancelFd)
+		var wfds *unix.FdSet
+		if write {
+			wfds = &unix.FdSet{}
+			fdSet(wfds, u.fd)
+		} else {
+			fdSet(rfds, u.fd)
+		}
+
+		n, err := unix.Select(maxFd+1, rfds, wfds, nil, selectTimeout(ctx, deadline))
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if n == 0 {
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				return os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		if fdIsSet(rfds, cancelFd) {
+			return os.ErrClosed
+		}
+		return nil
+	}
+}
+
+// selectTimeout computes the unix.Select timeout needed to honor both
+// ctx's deadline and deadline, capped at a short poll interval whenever
+// ctx is cancelable (select can't wait on a context.Done() channel
+// directly), or nil (block forever) when there is no deadline and ctx
+// can't be canceled.
+func selectTimeout(ctx context.Context, deadline time.Time) *unix.Timeval {
+	until := deadline
+	if ctxDeadline, ok := ctx.Deadline(); ok && (until.IsZero() || ctxDeadline.Before(until)) {
+		until = ctxDeadline
+	}
+	if until.IsZero() {
+		if ctx.Done() == nil {
+			return nil
+		}
+		tv := unix.NsecToTimeval(int64(200 * time.Millisecond))
+		return &tv
+	}
+	remaining := time.Until(until)
+	if remaining < 0 {
+		remaining = 0
+	}
+	if ctx.Done() != nil && remaining > 200*time.Millisecond {
+		remaining = 200 * time.Millisecond
+	}
+	tv := unix.NsecToTimeval(int64(remaining))
+	return &tv
+}
+
+// ipPacketVersion returns 4 or 6 depending on the IP version encoded in
+// the first nibble of an IP packet, defaulting to 4 for short or
+// malformed input so that callers always get a usable address family.
+func ipPacketVersion(packet []byte) int {
+	if len(packet) > 0 && packet[0]>>4 == 6 {
+		return 6
+	}
+	return 4
 }
 
 func (u *utunSocket) MTU() (mtu int, err error) {
@@ -140,6 +438,8 @@ func (u *utunSocket) Addresses() (local, dest net.IP, mask net.IPMask, err error
 	return ips[0], ips[1], net.IPMask(ips[2]), nil
 }
 
+// SetAddresses assigns a point-to-point IPv4 address to the tunnel. Use
+// SetAddresses6 for IPv6.
 func (u *utunSocket) SetAddresses(local, dest net.IP, mask net.IPMask) (err error) {
 	defer essentials.AddCtxTo("set addresses", &err)
 
@@ -159,12 +459,80 @@ func (u *utunSocket) SetAddresses(local, dest net.IP, mask net.IPMask) (err erro
 	return nil
 }
 
+// SetAddresses6 assigns addr as an IPv6 address on the tunnel. It
+// attaches the IPv6 protocol to the interface first, since utun
+// devices don't carry IPv6 until SIOCPROTOATTACH_IN6 is issued.
+func (u *utunSocket) SetAddresses6(addr net.IPNet) (err error) {
+	defer essentials.AddCtxTo("set IPv6 address", &err)
+
+	if addr.IP.To4() != nil || addr.IP.To16() == nil {
+		return errors.New("only IPv6 is supported")
+	}
+
+	// Ignore the error: repeated attaches on an already-attached
+	// interface are harmless, and there's no portable way to tell
+	// "already attached" apart from other failures here.
+	u.ifreqIOCTL(ioctlSIOCPROTOATTACH_IN6, make([]byte, 4))
+
+	ones, _ := addr.Mask.Size()
+	var aliasReq bytes.Buffer
+	aliasReq.Write(packSockaddr6(addr.IP))
+	aliasReq.Write(packSockaddr6(net.IPv6zero))
+	aliasReq.Write(packSockaddr6(net.IP(net.CIDRMask(ones, 128))))
+	binary.Write(&aliasReq, systemByteOrder, uint32(0))          // ifra6_flags
+	binary.Write(&aliasReq, systemByteOrder, uint32(0xffffffff)) // ia6t_vltime
+	binary.Write(&aliasReq, systemByteOrder, uint32(0xffffffff)) // ia6t_pltime
+	return u.ifreqIOCTL(ioctlSIOCAIFADDR_IN6, aliasReq.Bytes())
+}
+
+// AddRoute installs a route for dst via gw (or a direct route if gw is
+// nil) through the tunnel, via a PF_ROUTE socket.
+func (u *utunSocket) AddRoute(dst *net.IPNet, gw net.IP) (err error) {
+	defer essentials.AddCtxTo("add route", &err)
+	iface, err := net.InterfaceByName(u.Name())
+	if err != nil {
+		return err
+	}
+	return addRoute(iface.Index, dst, gw)
+}
+
+// DeleteRoute removes a route previously installed with AddRoute.
+func (u *utunSocket) DeleteRoute(dst *net.IPNet, gw net.IP) (err error) {
+	defer essentials.AddCtxTo("delete route", &err)
+	iface, err := net.InterfaceByName(u.Name())
+	if err != nil {
+		return err
+	}
+	return deleteRoute(iface.Index, dst, gw)
+}
+
+// Routes lists the routes currently installed through the tunnel.
+func (u *utunSocket) Routes() (routes []Route, err error) {
+	defer essentials.AddCtxTo("list routes", &err)
+	iface, err := net.InterfaceByName(u.Name())
+	if err != nil {
+		return nil, err
+	}
+	return listRoutes(iface.Index)
+}
+
 func (u *utunSocket) Close() (err error) {
 	defer essentials.AddCtxTo("close", &err)
 	if err := u.retain(); err != nil {
 		return err
 	}
 	defer u.release()
+
+	u.refLock.Lock()
+	u.closed = true
+	u.refLock.Unlock()
+
+	// Wake up any goroutine blocked in waitFD so it observes os.ErrClosed
+	// immediately, instead of only unblocking once its own ctx or
+	// deadline fires. The pipe itself is released by release once the
+	// last reference is dropped.
+	u.cancel.cancel()
+
 	return unix.Shutdown(u.fd, unix.SHUT_RDWR)
 }
 
@@ -235,5 +603,6 @@ func (u *utunSocket) release() {
 	u.refCount -= 1
 	if u.closed && u.refCount == 0 {
 		unix.Close(u.fd)
+		u.cancel.close()
 	}
 }
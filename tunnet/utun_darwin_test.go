@@ -0,0 +1,24 @@
+// +build darwin
+
+package tunnet
+
+import "testing"
+
+func TestIPPacketVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  []byte
+		version int
+	}{
+		{"IPv4", []byte{0x45, 0x00}, 4},
+		{"IPv6", []byte{0x60, 0x00}, 6},
+		{"empty", nil, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if v := ipPacketVersion(test.packet); v != test.version {
+				t.Errorf("expected version %d, got %d", test.version, v)
+			}
+		})
+	}
+}